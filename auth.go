@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Auth authorizes a connection after its TLS handshake (or, for
+// modePassthrough backends, after its SNI is known, in which case cs
+// is nil) but before it is dialed to a backend. It may consume
+// leading bytes of c, as peekClientHello does, in which case it
+// returns a connection that replays them. It returns a verified
+// identity to surface to the backend, or an error if the connection
+// should be rejected.
+type Auth interface {
+	Authorize(c net.Conn, info connInfo, cs *tls.ConnectionState) (net.Conn, string, error)
+}
+
+// NewAuth parses a URL-style auth spec, e.g. "basic://file=htpasswd",
+// "mtls://ca=clients.pem&require_cn=deploy", or
+// "ipacl://allow=10.0.0.0/8,172.16.0.0/12", and returns the Auth it
+// describes.
+func NewAuth(spec string) (Auth, error) {
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid auth spec %q: missing scheme", spec)
+	}
+	params, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth spec %q: %v", spec, err)
+	}
+	switch parts[0] {
+	case "ipacl":
+		return newIPACLAuth(params)
+	case "mtls":
+		return newMTLSAuth(params)
+	case "basic":
+		return newBasicAuth(params)
+	default:
+		return nil, fmt.Errorf("unknown auth scheme %q", parts[0])
+	}
+}
+
+// ipACLAuth authorizes by client IP address against an allowlist of
+// CIDRs. It's the only Auth that works on modePassthrough backends,
+// since it doesn't need a completed TLS handshake.
+type ipACLAuth struct {
+	allow []*net.IPNet
+}
+
+func newIPACLAuth(params url.Values) (Auth, error) {
+	a := new(ipACLAuth)
+	for _, cidr := range strings.Split(params.Get("allow"), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("ipacl: invalid CIDR %q: %v", cidr, err)
+		}
+		a.allow = append(a.allow, ipnet)
+	}
+	if len(a.allow) == 0 {
+		return nil, errors.New("ipacl: allow is empty or missing")
+	}
+	return a, nil
+}
+
+func (a *ipACLAuth) Authorize(c net.Conn, info connInfo, cs *tls.ConnectionState) (net.Conn, string, error) {
+	host, _, err := net.SplitHostPort(info.remoteAddr.String())
+	if err != nil {
+		return c, "", fmt.Errorf("ipacl: parsing remote address %v: %v", info.remoteAddr, err)
+	}
+	ip := net.ParseIP(host)
+	for _, ipnet := range a.allow {
+		if ipnet.Contains(ip) {
+			return c, host, nil
+		}
+	}
+	return c, "", fmt.Errorf("ipacl: %s is not allowed", host)
+}
+
+// mtlsAuth authorizes by verified client certificate. The matching
+// ClientCAs are also installed per SNI host via
+// proxy.getConfigForClient, since ClientAuth must be set before the
+// handshake completes rather than after.
+type mtlsAuth struct {
+	ca        *x509.CertPool
+	requireCN string
+}
+
+func newMTLSAuth(params url.Values) (Auth, error) {
+	caFile := params.Get("ca")
+	if caFile == "" {
+		return nil, errors.New("mtls: ca is empty or missing")
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("mtls: reading ca file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("mtls: no certificates found in %q", caFile)
+	}
+	return &mtlsAuth{ca: pool, requireCN: params.Get("require_cn")}, nil
+}
+
+func (a *mtlsAuth) Authorize(c net.Conn, info connInfo, cs *tls.ConnectionState) (net.Conn, string, error) {
+	if cs == nil {
+		return c, "", errors.New("mtls: requires TLS termination, incompatible with tcp+sni passthrough")
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return c, "", errors.New("mtls: no client certificate presented")
+	}
+	cn := cs.PeerCertificates[0].Subject.CommonName
+	if a.requireCN != "" && cn != a.requireCN {
+		return c, "", fmt.Errorf("mtls: certificate CN %q does not match required %q", cn, a.requireCN)
+	}
+	return c, cn, nil
+}
+
+// basicAuth authorizes http/1.1 connections by peeking the first
+// request's Authorization header and checking it against an htpasswd
+// file. Only the "{SHA}" entry format (as written by `htpasswd -s`)
+// is supported.
+type basicAuth struct {
+	file string
+}
+
+func newBasicAuth(params url.Values) (Auth, error) {
+	file := params.Get("file")
+	if file == "" {
+		return nil, errors.New("basic: file is empty or missing")
+	}
+	return &basicAuth{file: file}, nil
+}
+
+func (a *basicAuth) Authorize(c net.Conn, info connInfo, cs *tls.ConnectionState) (net.Conn, string, error) {
+	if info.alpnProto != "http/1.1" {
+		return c, "", fmt.Errorf("basic: requires http/1.1, got %q", info.alpnProto)
+	}
+	header, bc, err := peekHTTPHeaders(c)
+	if err != nil {
+		return c, "", fmt.Errorf("basic: %v", err)
+	}
+	user, pass, ok := parseBasicAuthHeader(header)
+	if !ok {
+		return bc, "", errors.New("basic: missing or malformed Authorization header")
+	}
+	creds, err := loadHtpasswd(a.file)
+	if err != nil {
+		return bc, "", fmt.Errorf("basic: %v", err)
+	}
+	want, ok := creds[user]
+	if !ok || !verifyHtpasswd(want, pass) {
+		return bc, "", fmt.Errorf("basic: invalid credentials for %q", user)
+	}
+	return bc, user, nil
+}
+
+// peekHTTPHeaders reads up to the blank line ending an HTTP request's
+// headers without consuming them, returning the raw header bytes and
+// a connection that replays them.
+func peekHTTPHeaders(c net.Conn) ([]byte, *bufferedConn, error) {
+	var buf bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(c, &buf))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading HTTP request headers: %v", err)
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if buf.Len() > 16<<10 {
+			return nil, nil, errors.New("HTTP request headers too large")
+		}
+	}
+	return buf.Bytes(), &bufferedConn{Conn: c, buf: bytes.NewReader(buf.Bytes())}, nil
+}
+
+// splitOnce splits s on the first occurrence of sep, like
+// strings.Cut in newer Go versions.
+func splitOnce(s, sep string) (before, after string, found bool) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+func parseBasicAuthHeader(header []byte) (user, pass string, ok bool) {
+	for _, line := range strings.Split(string(header), "\r\n") {
+		name, value, found := splitOnce(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "authorization") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		const prefix = "Basic "
+		if !strings.HasPrefix(value, prefix) {
+			return "", "", false
+		}
+		dec, err := base64.StdEncoding.DecodeString(value[len(prefix):])
+		if err != nil {
+			return "", "", false
+		}
+		u, p, found := splitOnce(string(dec), ":")
+		if !found {
+			return "", "", false
+		}
+		return u, p, true
+	}
+	return "", "", false
+}
+
+// loadHtpasswd parses an htpasswd file into a map of username to
+// password hash entry.
+func loadHtpasswd(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading htpasswd file: %v", err)
+	}
+	creds := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := splitOnce(line, ":")
+		if !found {
+			continue
+		}
+		creds[user] = hash
+	}
+	return creds, nil
+}
+
+// verifyHtpasswd checks pass against an htpasswd "{SHA}" entry, the
+// format `htpasswd -s` writes: base64(sha1(pass)). The comparison is
+// constant-time so a timing attack can't recover the hash byte by byte.
+func verifyHtpasswd(entry, pass string) bool {
+	const prefix = "{SHA}"
+	if !strings.HasPrefix(entry, prefix) {
+		return false
+	}
+	sum := sha1.Sum([]byte(pass))
+	want := base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(entry[len(prefix):]), []byte(want)) == 1
+}
+
+// identityHeaderName is the header injected into every request of an
+// http/1.1 connection carrying the identity an Auth returned.
+const identityHeaderName = "X-Tlsmuxd-Identity"
+
+// injectIdentityHeader peeks the first HTTP/1.1 request on c, strips
+// any client-supplied identityHeaderName header (so a client can't
+// spoof or collide with the one we're about to add), and inserts our
+// own right after the request line. It also rewrites Connection to
+// "close": identity injection only rewrites the first request on the
+// connection, so without forcing the backend to close afterward, every
+// request past the first on a keep-alive connection would silently
+// reach the backend with no identity header at all. The closed
+// connection in turn makes backend.handle tear down the client side
+// too, so a client that wants to keep talking has to open a new
+// connection, which goes through authorization again from scratch.
+func injectIdentityHeader(c net.Conn, identity string) (net.Conn, error) {
+	br := bufio.NewReader(c)
+	requestLine, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading HTTP request line: %v", err)
+	}
+	size := len(requestLine)
+	var headers []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("reading HTTP request headers: %v", err)
+		}
+		size += len(line)
+		if size > 16<<10 {
+			return nil, errors.New("HTTP request headers too large")
+		}
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if name, _, found := splitOnce(line, ":"); found && isInjectedHeader(name) {
+			continue
+		}
+		headers = append(headers, line)
+	}
+	var rewritten bytes.Buffer
+	rewritten.WriteString(requestLine)
+	for _, h := range headers {
+		rewritten.WriteString(h)
+	}
+	fmt.Fprintf(&rewritten, "%s: %s\r\n", identityHeaderName, identity)
+	rewritten.WriteString("Connection: close\r\n")
+	rewritten.WriteString("\r\n")
+	leftover := make([]byte, br.Buffered())
+	if _, err := io.ReadFull(br, leftover); err != nil {
+		return nil, fmt.Errorf("draining HTTP request buffer: %v", err)
+	}
+	rewritten.Write(leftover)
+	return &bufferedConn{Conn: c, buf: bytes.NewReader(rewritten.Bytes())}, nil
+}
+
+// isInjectedHeader reports whether name is a header injectIdentityHeader
+// itself adds, so a client-supplied copy of it gets stripped instead of
+// duplicated.
+func isInjectedHeader(name string) bool {
+	name = strings.TrimSpace(name)
+	return strings.EqualFold(name, identityHeaderName) || strings.EqualFold(name, "Connection")
+}
@@ -0,0 +1,98 @@
+package main
+
+import "testing"
+
+func TestVerifyHtpasswd(t *testing.T) {
+	// {SHA}5en6G6MezRroT3XKqkdPOmY/BfQ= is the {SHA} entry htpasswd -s
+	// writes for the password "secret".
+	const entry = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+
+	tests := []struct {
+		name  string
+		entry string
+		pass  string
+		want  bool
+	}{
+		{name: "correct password", entry: entry, pass: "secret", want: true},
+		{name: "wrong password", entry: entry, pass: "wrong", want: false},
+		{name: "unsupported entry format", entry: "$apr1$foo$bar", pass: "secret", want: false},
+		{name: "empty entry", entry: "", pass: "secret", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyHtpasswd(tt.entry, tt.pass); got != tt.want {
+				t.Errorf("verifyHtpasswd(%q, %q) = %v, want %v", tt.entry, tt.pass, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBasicAuthHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		wantUser string
+		wantPass string
+		wantOK   bool
+	}{
+		{
+			name:     "valid header",
+			header:   "Host: example.com\r\nAuthorization: Basic dXNlcjpwYXNz\r\n", // user:pass
+			wantUser: "user",
+			wantPass: "pass",
+			wantOK:   true,
+		},
+		{
+			name:   "missing header",
+			header: "Host: example.com\r\n",
+			wantOK: false,
+		},
+		{
+			name:   "not basic scheme",
+			header: "Authorization: Bearer abc123\r\n",
+			wantOK: false,
+		},
+		{
+			name:   "malformed base64",
+			header: "Authorization: Basic not-base64!!\r\n",
+			wantOK: false,
+		},
+		{
+			name:   "missing colon separator",
+			header: "Authorization: Basic dXNlcnBhc3M=\r\n", // "userpass", no ':'
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, pass, ok := parseBasicAuthHeader([]byte(tt.header))
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if user != tt.wantUser || pass != tt.wantPass {
+				t.Errorf("got user=%q pass=%q, want user=%q pass=%q", user, pass, tt.wantUser, tt.wantPass)
+			}
+		})
+	}
+}
+
+func TestIsInjectedHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "X-Tlsmuxd-Identity", want: true},
+		{name: "x-tlsmuxd-identity", want: true},
+		{name: "Connection", want: true},
+		{name: "connection", want: true},
+		{name: "Host", want: false},
+	}
+	for _, tt := range tests {
+		if got := isInjectedHeader(tt.name); got != tt.want {
+			t.Errorf("isInjectedHeader(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// clientHello holds the handful of ClientHello fields tlsmuxd needs
+// for routing: the requested server name and the client's proposed
+// ALPN protocols.
+type clientHello struct {
+	serverName string
+	alpnProtos []string
+}
+
+// bufferedConn is a net.Conn that first replays bytes consumed by an
+// earlier peek before falling through to the underlying connection.
+// It lets proxy.handle inspect a ClientHello without consuming it, so
+// the same bytes can be re-read by tls.Server or spliced to a backend
+// untouched.
+type bufferedConn struct {
+	net.Conn
+	buf *bytes.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.buf == nil {
+		return c.Conn.Read(p)
+	}
+	n, err := c.buf.Read(p)
+	if err == io.EOF {
+		c.buf = nil
+		if n == 0 {
+			return c.Conn.Read(p)
+		}
+		return n, nil
+	}
+	return n, err
+}
+
+// peekClientHello reads the TLS ClientHello off c without consuming
+// it and returns the parsed hello alongside a connection that will
+// replay the peeked bytes to the next reader. It only handles a
+// ClientHello contained in a single TLS record, which covers every
+// client in practice.
+func peekClientHello(c net.Conn) (*clientHello, *bufferedConn, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return nil, nil, fmt.Errorf("reading record header: %v", err)
+	}
+	if hdr[0] != 0x16 {
+		return nil, nil, fmt.Errorf("not a TLS handshake record (type %#x)", hdr[0])
+	}
+	recLen := int(hdr[3])<<8 | int(hdr[4])
+	body := make([]byte, recLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, nil, fmt.Errorf("reading record body: %v", err)
+	}
+
+	record := make([]byte, 0, len(hdr)+len(body))
+	record = append(record, hdr...)
+	record = append(record, body...)
+	bc := &bufferedConn{Conn: c, buf: bytes.NewReader(record)}
+
+	if len(body) < 4 || body[0] != 0x01 {
+		return nil, nil, fmt.Errorf("not a ClientHello (handshake type %#x)", body[0])
+	}
+	hsLen := int(body[1])<<16 | int(body[2])<<8 | int(body[3])
+	if hsLen > len(body)-4 {
+		return nil, nil, errors.New("ClientHello spans multiple TLS records, unsupported")
+	}
+	hello, err := parseClientHello(body[4 : 4+hsLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return hello, bc, nil
+}
+
+// parseClientHello parses the body of a ClientHello handshake message
+// (after the 4-byte handshake header) and extracts the server_name
+// and application_layer_protocol_negotiation extensions.
+func parseClientHello(b []byte) (*clientHello, error) {
+	if len(b) < 34 {
+		return nil, errors.New("ClientHello too short")
+	}
+	b = b[2+32:] // client_version, random
+
+	sessIDLen := int(b[0])
+	b = b[1:]
+	if len(b) < sessIDLen {
+		return nil, errors.New("ClientHello truncated (session id)")
+	}
+	b = b[sessIDLen:]
+
+	if len(b) < 2 {
+		return nil, errors.New("ClientHello truncated (cipher suites)")
+	}
+	csLen := int(b[0])<<8 | int(b[1])
+	b = b[2:]
+	if len(b) < csLen {
+		return nil, errors.New("ClientHello truncated (cipher suites)")
+	}
+	b = b[csLen:]
+
+	if len(b) < 1 {
+		return nil, errors.New("ClientHello truncated (compression methods)")
+	}
+	cmLen := int(b[0])
+	b = b[1:]
+	if len(b) < cmLen {
+		return nil, errors.New("ClientHello truncated (compression methods)")
+	}
+	b = b[cmLen:]
+
+	hello := &clientHello{}
+	if len(b) == 0 {
+		// No extensions, so nothing to route on.
+		return hello, nil
+	}
+	if len(b) < 2 {
+		return nil, errors.New("ClientHello truncated (extensions)")
+	}
+	extLen := int(b[0])<<8 | int(b[1])
+	b = b[2:]
+	if len(b) < extLen {
+		return nil, errors.New("ClientHello truncated (extensions)")
+	}
+	b = b[:extLen]
+
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("ClientHello truncated (extension header)")
+		}
+		extType := int(b[0])<<8 | int(b[1])
+		extBodyLen := int(b[2])<<8 | int(b[3])
+		b = b[4:]
+		if len(b) < extBodyLen {
+			return nil, errors.New("ClientHello truncated (extension body)")
+		}
+		extBody := b[:extBodyLen]
+		b = b[extBodyLen:]
+
+		switch extType {
+		case 0: // server_name
+			name, err := parseServerName(extBody)
+			if err != nil {
+				return nil, err
+			}
+			hello.serverName = name
+		case 16: // application_layer_protocol_negotiation
+			protos, err := parseALPN(extBody)
+			if err != nil {
+				return nil, err
+			}
+			hello.alpnProtos = protos
+		}
+	}
+	return hello, nil
+}
+
+func parseServerName(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", errors.New("server_name extension truncated")
+	}
+	listLen := int(b[0])<<8 | int(b[1])
+	b = b[2:]
+	if len(b) < listLen {
+		return "", errors.New("server_name extension truncated")
+	}
+	b = b[:listLen]
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return "", errors.New("server_name entry truncated")
+		}
+		nameType := b[0]
+		nameLen := int(b[1])<<8 | int(b[2])
+		b = b[3:]
+		if len(b) < nameLen {
+			return "", errors.New("server_name entry truncated")
+		}
+		name := b[:nameLen]
+		b = b[nameLen:]
+		if nameType == 0 { // host_name
+			return string(name), nil
+		}
+	}
+	return "", nil
+}
+
+func parseALPN(b []byte) ([]string, error) {
+	if len(b) < 2 {
+		return nil, errors.New("alpn extension truncated")
+	}
+	listLen := int(b[0])<<8 | int(b[1])
+	b = b[2:]
+	if len(b) < listLen {
+		return nil, errors.New("alpn extension truncated")
+	}
+	b = b[:listLen]
+	var protos []string
+	for len(b) > 0 {
+		protoLen := int(b[0])
+		b = b[1:]
+		if len(b) < protoLen {
+			return nil, errors.New("alpn protocol truncated")
+		}
+		protos = append(protos, string(b[:protoLen]))
+		b = b[protoLen:]
+	}
+	return protos, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// buildExtension encodes a single ClientHello extension (type, body).
+func buildExtension(typ uint16, body []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(byte(typ >> 8))
+	b.WriteByte(byte(typ))
+	b.WriteByte(byte(len(body) >> 8))
+	b.WriteByte(byte(len(body)))
+	b.Write(body)
+	return b.Bytes()
+}
+
+// buildServerNameExtBody encodes a server_name extension body for a
+// single host_name entry.
+func buildServerNameExtBody(name string) []byte {
+	var b bytes.Buffer
+	entry := append([]byte{0x00, byte(len(name) >> 8), byte(len(name))}, name...)
+	listLen := len(entry)
+	b.WriteByte(byte(listLen >> 8))
+	b.WriteByte(byte(listLen))
+	b.Write(entry)
+	return b.Bytes()
+}
+
+// buildALPNExtBody encodes an alpn extension body for the given
+// protocol names.
+func buildALPNExtBody(protos ...string) []byte {
+	var list bytes.Buffer
+	for _, p := range protos {
+		list.WriteByte(byte(len(p)))
+		list.WriteString(p)
+	}
+	var b bytes.Buffer
+	b.WriteByte(byte(list.Len() >> 8))
+	b.WriteByte(byte(list.Len()))
+	b.Write(list.Bytes())
+	return b.Bytes()
+}
+
+// buildClientHelloBody assembles the body of a ClientHello handshake
+// message (after the 4-byte handshake header) with the given
+// extensions, suitable for feeding to parseClientHello.
+func buildClientHelloBody(extensions ...[]byte) []byte {
+	var b bytes.Buffer
+	b.Write(make([]byte, 2+32)) // client_version, random
+	b.WriteByte(0)              // session id length
+	b.WriteByte(0)              // cipher suites length hi
+	b.WriteByte(0)              // cipher suites length lo
+	b.WriteByte(0)              // compression methods length
+
+	var exts bytes.Buffer
+	for _, e := range extensions {
+		exts.Write(e)
+	}
+	b.WriteByte(byte(exts.Len() >> 8))
+	b.WriteByte(byte(exts.Len()))
+	b.Write(exts.Bytes())
+	return b.Bytes()
+}
+
+func TestParseClientHello(t *testing.T) {
+	sni := buildExtension(0, buildServerNameExtBody("example.com"))
+	alpn := buildExtension(16, buildALPNExtBody("h2", "http/1.1"))
+
+	tests := []struct {
+		name       string
+		body       []byte
+		wantSNI    string
+		wantProtos []string
+		wantErr    bool
+	}{
+		{
+			name:       "no extensions",
+			body:       buildClientHelloBody(),
+			wantSNI:    "",
+			wantProtos: nil,
+		},
+		{
+			name:       "sni and alpn",
+			body:       buildClientHelloBody(sni, alpn),
+			wantSNI:    "example.com",
+			wantProtos: []string{"h2", "http/1.1"},
+		},
+		{
+			name:       "alpn only",
+			body:       buildClientHelloBody(alpn),
+			wantSNI:    "",
+			wantProtos: []string{"h2", "http/1.1"},
+		},
+		{
+			name:    "too short",
+			body:    []byte{0x01, 0x02},
+			wantErr: true,
+		},
+		{
+			// extType 0x0000, extBodyLen 5, but only 2 bytes of body follow.
+			name:    "truncated extension body",
+			body:    buildClientHelloBody([]byte{0x00, 0x00, 0x00, 0x05, 0x01, 0x02}),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello, err := parseClientHello(tt.body)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hello.serverName != tt.wantSNI {
+				t.Errorf("serverName = %q, want %q", hello.serverName, tt.wantSNI)
+			}
+			if !equalStrings(hello.alpnProtos, tt.wantProtos) {
+				t.Errorf("alpnProtos = %v, want %v", hello.alpnProtos, tt.wantProtos)
+			}
+		})
+	}
+}
+
+func TestParseServerName(t *testing.T) {
+	got, err := parseServerName(buildServerNameExtBody("example.com"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "example.com" {
+		t.Errorf("got %q, want %q", got, "example.com")
+	}
+
+	if _, err := parseServerName([]byte{0x00}); err == nil {
+		t.Error("expected an error for a truncated extension, got nil")
+	}
+}
+
+func TestParseALPN(t *testing.T) {
+	got, err := parseALPN(buildALPNExtBody("h2", "http/1.1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"h2", "http/1.1"}
+	if !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := parseALPN([]byte{0x00, 0x05, 0x02, 'h', '2'}); err == nil {
+		t.Error("expected an error for a truncated protocol, got nil")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nhooyr/log"
+)
+
+// fields is a set of structured log fields, logged alongside a short
+// message in logfmt style (key=value, sorted by key for stable
+// output) instead of being interpolated into a free-form sentence.
+type fields map[string]interface{}
+
+// logEvent writes msg to the log with f appended, e.g.
+// logEvent("handshake error", fields{"remote_addr": c.RemoteAddr(), "error": err})
+// prints `handshake error remote_addr=1.2.3.4:5678 error=...`.
+func logEvent(msg string, f fields) {
+	log.Print(formatEvent(msg, f))
+}
+
+func formatEvent(msg string, f fields) string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, k := range keys {
+		if v := f[k]; v != nil {
+			fmt.Fprintf(&b, " %s=%s", k, formatFieldValue(v))
+		}
+	}
+	return b.String()
+}
+
+// formatFieldValue quotes a field's value if it contains characters
+// that would make the logfmt line ambiguous to split back apart.
+func formatFieldValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
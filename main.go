@@ -1,15 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"io/ioutil"
 	stdlog "log"
 	"net"
 	"os"
 	"os/signal"
-	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/nhooyr/log"
 	"github.com/xenolf/lego/acme"
@@ -20,51 +19,27 @@ func init() {
 }
 
 func main() {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		log.Print("terminating")
-		os.Exit(0)
-	}()
-
 	configDir := flag.String("c", "/usr/local/etc/tlsmuxd", "path to the configuration directory")
 	flag.Parse()
-	err := os.Chdir(*configDir)
-	if err != nil {
-		log.Fatal(err)
-	}
-	f, err := os.Open("config.json")
-	if err != nil {
+	if err := os.Chdir(*configDir); err != nil {
 		log.Fatal(err)
 	}
 
-	p := new(proxy)
-	err = json.NewDecoder(f).Decode(&p)
+	p, err := loadProxy()
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = f.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = p.init()
-	if err != nil {
+	s := &server{p: p}
+	if err := s.listen(); err != nil {
 		log.Fatal(err)
 	}
 
-	for _, host := range p.BindInterfaces {
-		l, err := net.Listen("tcp", net.JoinHostPort(host, "https"))
-		if err != nil {
-			log.Fatal(err)
-		}
-		go func() {
-			log.Fatal(p.serve(tcpKeepAliveListener{l.(*net.TCPListener)}))
-		}()
-	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	go s.handleSignals(sigs)
 
 	log.Print("initialized")
-	runtime.Goexit()
+	s.serve()
 }
 
 type tcpKeepAliveListener struct {
@@ -77,6 +52,6 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 		return
 	}
 	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(d.KeepAlive)
+	tc.SetKeepAlivePeriod(3 * time.Minute)
 	return tc, nil
 }
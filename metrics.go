@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics exposed at /metrics, in the style of the Prometheus client
+// libraries but hand-rolled to avoid a dependency on one.
+var (
+	handshakesTotal = newCounterVec("tlsmuxd_handshakes_total",
+		"Total TLS handshakes attempted, by result and negotiated ALPN protocol.", "result", "alpn")
+	handshakeDuration = newHistogram("tlsmuxd_handshake_duration_seconds",
+		"TLS handshake duration in seconds.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+	activeConnections = newGaugeVec("tlsmuxd_active_connections",
+		"Backend connections currently open, by proto and host.", "proto", "host")
+	bytesTotal = newCounterVec("tlsmuxd_bytes_total",
+		"Total bytes forwarded between clients and backends, by direction, proto and host.", "direction", "proto", "host")
+)
+
+// metricsMux builds the /metrics, /debug/vars and /debug/pprof/ mux
+// served by server.metricsListener, kept off the TLS listeners since
+// it's plaintext and meant to stay off the public network.
+func (p *proxy) metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.writeMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func (p *proxy) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	handshakesTotal.writeTo(w)
+	handshakeDuration.writeTo(w)
+	activeConnections.writeTo(w)
+	bytesTotal.writeTo(w)
+	writeCertExpiry(w, p.CacheDir)
+}
+
+// writeCertExpiry reads p.manager's autocert.DirCache directory
+// directly, since autocert.Cache doesn't expose a way to list what it
+// holds, and reports each cached certificate's expiry as a gauge.
+// Non-certificate cache entries, like the ACME account key, don't
+// parse as a certificate and are skipped.
+func writeCertExpiry(w io.Writer, cacheDir string) {
+	fmt.Fprintln(w, "# HELP tlsmuxd_cert_expiry_seconds Unix time the cached ACME certificate for a host expires.")
+	fmt.Fprintln(w, "# TYPE tlsmuxd_cert_expiry_seconds gauge")
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.Contains(entry.Name(), "+") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(cacheDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "tlsmuxd_cert_expiry_seconds{host=%q} %d\n", entry.Name(), cert.NotAfter.Unix())
+	}
+}
+
+func vecKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func labelPairs(labelNames []string, key string) string {
+	values := strings.Split(key, "\xff")
+	parts := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%q", name, v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// counterVec is a monotonically-increasing metric labeled by one or
+// more dimensions, e.g. tlsmuxd_bytes_total{direction,proto,host}.
+type counterVec struct {
+	mu         sync.Mutex
+	name, help string
+	labelNames []string
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+}
+
+func (v *counterVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *counterVec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	v.values[vecKey(labelValues)] += delta
+	v.mu.Unlock()
+}
+
+func (v *counterVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	for key, val := range v.values {
+		fmt.Fprintf(w, "%s{%s} %v\n", v.name, labelPairs(v.labelNames, key), val)
+	}
+}
+
+// gaugeVec is a metric labeled like counterVec but that can also go
+// down, e.g. tlsmuxd_active_connections{proto,host}.
+type gaugeVec struct {
+	mu         sync.Mutex
+	name, help string
+	labelNames []string
+	values     map[string]float64
+}
+
+func newGaugeVec(name, help string, labelNames ...string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, labelNames: labelNames, values: make(map[string]float64)}
+}
+
+func (v *gaugeVec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+func (v *gaugeVec) Dec(labelValues ...string) {
+	v.Add(-1, labelValues...)
+}
+
+func (v *gaugeVec) Add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	v.values[vecKey(labelValues)] += delta
+	v.mu.Unlock()
+}
+
+func (v *gaugeVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", v.name, v.help, v.name)
+	for key, val := range v.values {
+		fmt.Fprintf(w, "%s{%s} %v\n", v.name, labelPairs(v.labelNames, key), val)
+	}
+}
+
+// histogram buckets observations into cumulative, non-labeled
+// buckets, e.g. tlsmuxd_handshake_duration_seconds.
+type histogram struct {
+	mu         sync.Mutex
+	name, help string
+	buckets    []float64
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	h.sum += v
+	h.count++
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.mu.Unlock()
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.buckets {
+		// counts[i] is already cumulative: Observe increments every
+		// bucket an observation is <= to, not just the tightest one.
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestHistogramObserveCumulative guards against the bucket counts being
+// double-cumulated: Observe should increment every bucket an
+// observation is <= to exactly once per call, and writeTo should treat
+// counts[i] as already cumulative rather than summing them again.
+func TestHistogramObserveCumulative(t *testing.T) {
+	h := newHistogram("test_histogram", "a test histogram", []float64{1, 5, 10})
+	h.Observe(0.5) // falls in every bucket
+	h.Observe(7)   // falls in the 10 bucket only
+
+	want := []uint64{1, 1, 2}
+	for i, w := range want {
+		if h.counts[i] != w {
+			t.Errorf("counts[%d] = %d, want %d", i, h.counts[i], w)
+		}
+	}
+	if h.count != 2 {
+		t.Errorf("count = %d, want 2", h.count)
+	}
+	if h.sum != 7.5 {
+		t.Errorf("sum = %v, want 7.5", h.sum)
+	}
+}
+
+func TestHistogramWriteTo(t *testing.T) {
+	h := newHistogram("test_histogram", "a test histogram", []float64{1, 5, 10})
+	h.Observe(0.5)
+	h.Observe(7)
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		`test_histogram_bucket{le="1"} 1`,
+		`test_histogram_bucket{le="5"} 1`,
+		`test_histogram_bucket{le="10"} 2`,
+		`test_histogram_bucket{le="+Inf"} 2`,
+		`test_histogram_count 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestCounterVecAdd(t *testing.T) {
+	v := newCounterVec("test_counter", "a test counter", "result")
+	v.Inc("ok")
+	v.Inc("ok")
+	v.Add(3, "error")
+
+	var buf bytes.Buffer
+	v.writeTo(&buf)
+	out := buf.String()
+	if !strings.Contains(out, `test_counter{result="ok"} 2`) {
+		t.Errorf("output missing ok=2, got:\n%s", out)
+	}
+	if !strings.Contains(out, `test_counter{result="error"} 3`) {
+		t.Errorf("output missing error=3, got:\n%s", out)
+	}
+}
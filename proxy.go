@@ -3,11 +3,13 @@ package main
 import (
 	"crypto/rand"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,21 +19,115 @@ import (
 	"github.com/nhooyr/log"
 )
 
+// modePassthrough marks a proto whose hosts should be routed purely
+// on the ClientHello's SNI and spliced through untouched, instead of
+// having TLS terminated locally.
+const modePassthrough = "tcp+sni"
+
+// defaultHandshakeTimeout bounds how long an accepted connection may
+// spend being PROXY-protocol-parsed, ClientHello-peeked, TLS-handshaken
+// and authorized before a backend is ever picked. It's the only thing
+// standing between a slowloris-style client and a goroutine it gets to
+// hold open for free; backend.handle takes over deadline management
+// (idleTimeout/maxDuration) once a backend is actually dialed.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// hostConfig is a backend address, optionally with PROXY protocol
+// settings. It unmarshals from either a bare "host:port" string, the
+// common case, or an object when per-backend options are needed.
+type hostConfig struct {
+	Addr string `json:"addr"`
+	// SendProxyProto prepends a PROXY protocol header ("v1" or "v2")
+	// to the connection dialed to this backend, carrying the
+	// original client's address and, for v2, its TLS version, SNI
+	// and negotiated ALPN as TLVs.
+	SendProxyProto string `json:"sendProxyProto,omitempty"`
+}
+
+func (h *hostConfig) UnmarshalJSON(data []byte) error {
+	var addr string
+	if err := json.Unmarshal(data, &addr); err == nil {
+		h.Addr = addr
+		return nil
+	}
+	type plain hostConfig
+	return json.Unmarshal(data, (*plain)(h))
+}
+
 // TODO custom config file
 type proxy struct {
 	BindInterfaces []string `json:"bindInterfaces"`
 	Email          string   `json:"email"`
 	CacheDir       string   `json:"cacheDir"`
 	Protos         []struct {
-		Name  string            `json:"name"`
-		Hosts map[string]string `json:"hosts"`
+		Name  string                `json:"name"`
+		Hosts map[string]hostConfig `json:"hosts"`
+		// Mode selects how connections for this proto's hosts are
+		// handled. The zero value ("" or "terminate") terminates
+		// TLS locally like every other proto. modePassthrough
+		// instead peeks the SNI and splices the raw TLS bytes to
+		// the backend, for services that terminate TLS themselves.
+		Mode string `json:"mode,omitempty"`
+		// Auth is a URL-style spec selecting an Auth to run before
+		// dialing any of this proto's backends, e.g.
+		// "mtls://ca=clients.pem". See NewAuth.
+		Auth string `json:"auth,omitempty"`
+		// IdleTimeoutSeconds bounds how long a connection to one of
+		// this proto's backends may go without forwarding a byte in
+		// either direction before it's closed. Reset after every
+		// successful read; defaults to defaultIdleTimeout.
+		IdleTimeoutSeconds int `json:"idleTimeoutSeconds,omitempty"`
+		// MaxDurationSeconds, if set, bounds how long a connection may
+		// stay open in total, regardless of activity.
+		MaxDurationSeconds int `json:"maxDurationSeconds,omitempty"`
 	} `json:"protos"`
 	DefaultProto string `json:"defaultProto"`
+	// AcceptProxyProto makes every listener expect connections to
+	// begin with a PROXY protocol v1 or v2 header, recovering the
+	// true client address before handshake and logging. Use this
+	// when tlsmuxd sits behind another L4 load balancer.
+	AcceptProxyProto bool `json:"acceptProxyProto,omitempty"`
+	// DrainTimeoutSeconds bounds how long a graceful shutdown or
+	// reload waits for in-flight connections before force-closing
+	// them. Defaults to 30s; see defaultDrainTimeout.
+	DrainTimeoutSeconds int `json:"drainTimeoutSeconds,omitempty"`
+	// TunnelListenAddr, if set, binds a control-plane listener that
+	// reverse-tunnel agents dial to register a "tunnel://<id>"
+	// backend, instead of tlsmuxd dialing out to them.
+	TunnelListenAddr string `json:"tunnelListenAddr,omitempty"`
+	// TunnelAgents maps a tunnel id to the token an agent must
+	// present when registering under it.
+	TunnelAgents map[string]string `json:"tunnelAgents,omitempty"`
+	// MetricsListenAddr, if set, binds an HTTP listener serving
+	// Prometheus metrics at /metrics, expvar at /debug/vars, and
+	// pprof at /debug/pprof/. It's separate from the proxy's TLS
+	// listeners since it's plaintext and meant to stay off the
+	// public network.
+	MetricsListenAddr string `json:"metricsListenAddr,omitempty"`
 
 	// Map of protocol names to hostnames to backends.
 	backends map[string]map[string]*backend
-	manager  autocert.Manager
-	config   *tls.Config
+	// Map of hostnames to backends for modePassthrough hosts, keyed
+	// independently of backends because passthrough connections are
+	// never ALPN-negotiated.
+	passthrough map[string]*backend
+	// Map of SNI hosts to the mtlsAuth guarding them, consulted by
+	// getConfigForClient to require a client certificate before the
+	// handshake completes.
+	mtlsHosts map[string]*mtlsAuth
+	tunnels   *tunnelRegistry
+	manager   autocert.Manager
+	config    *tls.Config
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+
+	// stop, once closed, ends rotateSessionTicketKeys. It's only ever
+	// closed on a *proxy built to validate a candidate config (see
+	// handleSignals's SIGHUP case) and then discarded, so that
+	// validation doesn't leak the goroutine forever.
+	stop chan struct{}
 }
 
 func (p *proxy) init() error {
@@ -43,10 +139,14 @@ func (p *proxy) init() error {
 	}
 	p.config = &tls.Config{
 		GetCertificate:           p.manager.GetCertificate,
+		GetConfigForClient:       p.getConfigForClient,
 		PreferServerCipherSuites: true, // See golang/go#12895 for why.
 		MinVersion:               tls.VersionTLS12,
 	}
 	p.backends = make(map[string]map[string]*backend)
+	p.passthrough = make(map[string]*backend)
+	p.mtlsHosts = make(map[string]*mtlsAuth)
+	p.tunnels = newTunnelRegistry()
 	var hosts []string
 	for i, proto := range p.Protos {
 		if proto.Name == "" {
@@ -55,22 +155,73 @@ func (p *proxy) init() error {
 		if len(proto.Hosts) == 0 {
 			return fmt.Errorf("protos[%d].hosts is empty or missing", i)
 		}
+		switch proto.Mode {
+		case "", modePassthrough:
+		default:
+			return fmt.Errorf("protos[%d].mode is invalid: %q", i, proto.Mode)
+		}
+		var auth Auth
+		if proto.Auth != "" {
+			var err error
+			auth, err = NewAuth(proto.Auth)
+			if err != nil {
+				return fmt.Errorf("protos[%d].auth: %v", i, err)
+			}
+			if proto.Mode == modePassthrough {
+				if _, ok := auth.(*ipACLAuth); !ok {
+					return fmt.Errorf("protos[%d].auth: %q is incompatible with mode %q, only ipacl works without a completed handshake", i, proto.Auth, modePassthrough)
+				}
+			}
+		}
+		idleTimeout := defaultIdleTimeout
+		if proto.IdleTimeoutSeconds != 0 {
+			idleTimeout = time.Duration(proto.IdleTimeoutSeconds) * time.Second
+		}
+		var maxDuration time.Duration
+		if proto.MaxDurationSeconds != 0 {
+			maxDuration = time.Duration(proto.MaxDurationSeconds) * time.Second
+		}
 		p.backends[proto.Name] = make(map[string]*backend)
-		for host, addr := range proto.Hosts {
+		for host, hc := range proto.Hosts {
 			if host == "" {
 				return fmt.Errorf("empty key in protos[%d].hosts", i)
-			} else if addr == "" {
+			} else if hc.Addr == "" {
 				return fmt.Errorf("protos[%d].hosts.%q is empty", i, host)
 			}
-			p.backends[proto.Name][host] = &backend{
-				fmt.Sprintf("%q.%q: ", proto.Name, host),
-				addr,
+			switch hc.SendProxyProto {
+			case "", "v1", "v2":
+			default:
+				return fmt.Errorf("protos[%d].hosts.%q.sendProxyProto is invalid: %q", i, host, hc.SendProxyProto)
+			}
+			if hc.Addr == tunnelPrefix {
+				return fmt.Errorf("protos[%d].hosts.%q: tunnel id is empty", i, host)
+			}
+			b := &backend{
+				name:        fmt.Sprintf("%q.%q: ", proto.Name, host),
+				proto:       proto.Name,
+				host:        host,
+				addr:        hc.Addr,
+				proxyProto:  hc.SendProxyProto,
+				auth:        auth,
+				tunnels:     p.tunnels,
+				idleTimeout: idleTimeout,
+				maxDuration: maxDuration,
 			}
+			if mtls, ok := auth.(*mtlsAuth); ok {
+				p.mtlsHosts[host] = mtls
+			}
+			if proto.Mode == modePassthrough {
+				p.passthrough[host] = b
+				continue
+			}
+			p.backends[proto.Name][host] = b
 			if !contains(hosts, host) {
 				hosts = append(hosts, host)
 			}
 		}
-		p.config.NextProtos = append(p.config.NextProtos, proto.Name)
+		if proto.Mode != modePassthrough {
+			p.config.NextProtos = append(p.config.NextProtos, proto.Name)
+		}
 	}
 	var ok bool
 	p.backends[""], ok = p.backends[p.DefaultProto]
@@ -99,10 +250,26 @@ func (p *proxy) init() error {
 		return fmt.Errorf("session ticket key generation failed: %v", err)
 	}
 	p.config.SetSessionTicketKeys(keys)
+	p.stop = make(chan struct{})
 	go p.rotateSessionTicketKeys(keys)
 	return nil
 }
 
+// getConfigForClient installs a per-SNI ClientAuth/ClientCAs for
+// hosts guarded by mtls auth, since those must be in place before the
+// handshake completes rather than after. It returns nil for every
+// other host, which tells crypto/tls to fall back to p.config.
+func (p *proxy) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	a, ok := p.mtlsHosts[hello.ServerName]
+	if !ok {
+		return nil, nil
+	}
+	cfg := p.config.Clone()
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.ClientCAs = a.ca
+	return cfg, nil
+}
+
 func contains(strs []string, s1 string) bool {
 	for _, s2 := range strs {
 		if s1 == s2 {
@@ -114,7 +281,11 @@ func contains(strs []string, s1 string) bool {
 
 func (p *proxy) rotateSessionTicketKeys(keys [][32]byte) {
 	for {
-		time.Sleep(1 * time.Hour)
+		select {
+		case <-time.After(1 * time.Hour):
+		case <-p.stop:
+			return
+		}
 		if len(keys) < cap(keys) {
 			keys = keys[:len(keys)+1]
 		}
@@ -144,41 +315,208 @@ func (p *proxy) serve(l net.Listener) error {
 						delay = time.Second
 					}
 				}
-				log.Printf("%v; retrying in %v", err, delay)
+				logEvent("accept error", fields{"error": err, "retry_in": delay})
 				time.Sleep(delay)
 				continue
 			}
 			return err
 		}
 		delay = 0
-		go p.handle(c)
+		p.trackConn(c)
+		go func() {
+			defer p.untrackConn(c)
+			p.handle(c)
+		}()
+	}
+}
+
+// trackConn registers c in the per-connection registry used by drain
+// to force-close whatever is still in flight after the timeout.
+func (p *proxy) trackConn(c net.Conn) {
+	p.connsMu.Lock()
+	if p.conns == nil {
+		p.conns = make(map[net.Conn]struct{})
+	}
+	p.conns[c] = struct{}{}
+	p.connsMu.Unlock()
+	p.wg.Add(1)
+}
+
+func (p *proxy) untrackConn(c net.Conn) {
+	p.connsMu.Lock()
+	delete(p.conns, c)
+	p.connsMu.Unlock()
+	p.wg.Done()
+}
+
+// drain waits up to timeout for every tracked connection's handle
+// goroutine to finish on its own, then force-closes whatever is left
+// so shutdown can't hang on a slowloris-style client.
+func (p *proxy) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		p.connsMu.Lock()
+		for c := range p.conns {
+			_ = c.Close()
+		}
+		p.connsMu.Unlock()
+		<-done
 	}
 }
 
 func (p *proxy) handle(c net.Conn) {
-	tlc := tls.Server(c, p.config)
-	err := tlc.Handshake()
+	if err := c.SetDeadline(time.Now().Add(defaultHandshakeTimeout)); err != nil {
+		logEvent("set deadline error", fields{"remote_addr": c.RemoteAddr(), "error": err})
+		_ = c.Close()
+		return
+	}
+	if p.AcceptProxyProto {
+		pc, addr, err := acceptProxyProtoHeader(c)
+		if err != nil {
+			logEvent("proxy protocol error", fields{"remote_addr": c.RemoteAddr(), "error": err})
+			_ = c.Close()
+			return
+		}
+		c = pc
+		if addr != nil {
+			c = &proxyProtoConn{Conn: pc, remoteAddr: addr}
+		}
+	}
+
+	hello, bc, err := peekClientHello(c)
 	if err != nil {
-		log.Printf("TLS handshake error from %v: %v", c.RemoteAddr(), err)
+		logEvent("clienthello error", fields{"remote_addr": c.RemoteAddr(), "error": err})
+		_ = c.Close()
+		return
+	}
+	if b, ok := p.passthrough[hello.serverName]; ok {
+		info := connInfo{
+			remoteAddr: c.RemoteAddr(),
+			localAddr:  c.LocalAddr(),
+			serverName: hello.serverName,
+			alpnProto:  firstALPN(hello.alpnProtos),
+		}
+		conn := net.Conn(bc)
+		if b.auth != nil {
+			var err error
+			conn, info.identity, err = b.auth.Authorize(conn, info, nil)
+			if err != nil {
+				logEvent("auth denied", fields{"remote_addr": c.RemoteAddr(), "sni": hello.serverName, "error": err})
+				_ = conn.Close()
+				return
+			}
+		}
+		// Past this point backend.handle owns deadline management via
+		// idleTimeout/maxDuration; clear the pre-dial one so it doesn't
+		// cut off an otherwise-healthy long-lived connection.
+		_ = conn.SetDeadline(time.Time{})
+		b.handle(conn, info)
+		return
+	}
+
+	start := time.Now()
+	tlc := tls.Server(bc, p.config)
+	err = tlc.Handshake()
+	handshakeMS := time.Since(start).Milliseconds()
+	if err != nil {
+		handshakesTotal.Inc("error", firstALPN(hello.alpnProtos))
+		logEvent("handshake error", fields{"remote_addr": c.RemoteAddr(), "sni": hello.serverName, "handshake_ms": handshakeMS, "error": err})
 		_ = c.Close()
 		return
 	}
 	cs := tlc.ConnectionState()
+	handshakesTotal.Inc("ok", cs.NegotiatedProtocol)
+	handshakeDuration.Observe(time.Since(start).Seconds())
 	// Protocol is guaranteed to exist.
 	hosts := p.backends[cs.NegotiatedProtocol]
 	b, ok := hosts[cs.ServerName]
 	if !ok {
-		log.Printf("unable to find %q.%q for %v", cs.NegotiatedProtocol,
-			cs.ServerName, c.RemoteAddr())
+		logEvent("backend not found", fields{"remote_addr": c.RemoteAddr(), "alpn": cs.NegotiatedProtocol, "sni": cs.ServerName})
 		_ = c.Close()
 		return
 	}
-	b.handle(tlc)
+	info := connInfo{
+		remoteAddr:         tlc.RemoteAddr(),
+		localAddr:          tlc.LocalAddr(),
+		serverName:         cs.ServerName,
+		alpnProto:          cs.NegotiatedProtocol,
+		tlsVersion:         cs.Version,
+		clientCertVerified: len(cs.PeerCertificates) > 0,
+	}
+	conn := net.Conn(tlc)
+	if b.auth != nil {
+		var err error
+		conn, info.identity, err = b.auth.Authorize(conn, info, &cs)
+		if err != nil {
+			logEvent("auth denied", fields{"remote_addr": c.RemoteAddr(), "sni": cs.ServerName, "alpn": cs.NegotiatedProtocol, "error": err})
+			_ = conn.Close()
+			return
+		}
+	}
+	// TODO identity injection is only implemented for http/1.1;
+	// propagating it over h2 needs a HEADERS-frame rewrite, not a
+	// byte-level prefix, so for now a verified identity on an h2
+	// connection is silently dropped except for this log line.
+	if info.identity != "" && info.alpnProto == "h2" {
+		logEvent("identity header unsupported for h2", fields{"remote_addr": c.RemoteAddr(), "sni": cs.ServerName})
+	}
+	if info.identity != "" && info.alpnProto == "http/1.1" {
+		conn, err = injectIdentityHeader(conn, info.identity)
+		if err != nil {
+			logEvent("identity header error", fields{"remote_addr": c.RemoteAddr(), "error": err})
+			_ = conn.Close()
+			return
+		}
+	}
+	// Past this point backend.handle owns deadline management via
+	// idleTimeout/maxDuration; clear the pre-dial one so it doesn't cut
+	// off an otherwise-healthy long-lived connection.
+	_ = conn.SetDeadline(time.Time{})
+	b.handle(conn, info)
+}
+
+func firstALPN(protos []string) string {
+	if len(protos) == 0 {
+		return ""
+	}
+	return protos[0]
 }
 
 type backend struct {
 	name string
+	// proto and host are the configured proto name and SNI host this
+	// backend serves, used only to label metrics and log fields.
+	proto, host string
+	// addr is either a "host:port" dial address or, prefixed with
+	// tunnelPrefix, a reverse-tunnel agent id; see dial.
 	addr string
+	// proxyProto is "", "v1" or "v2"; see hostConfig.SendProxyProto.
+	proxyProto string
+	// auth, if non-nil, must authorize a connection before it's
+	// dialed; see proxy.handle.
+	auth    Auth
+	tunnels *tunnelRegistry
+	// idleTimeout and maxDuration bound how long a connection to this
+	// backend may stay open; see proto.IdleTimeoutSeconds and
+	// proto.MaxDurationSeconds.
+	idleTimeout time.Duration
+	maxDuration time.Duration
+}
+
+// dial connects to the backend, either over TCP or, for a
+// tunnelPrefix address, by opening a multiplexed stream to the
+// registered agent.
+func (b *backend) dial() (net.Conn, error) {
+	if id := strings.TrimPrefix(b.addr, tunnelPrefix); id != b.addr {
+		return b.tunnels.dial(id)
+	}
+	return dialer.Dial("tcp", b.addr)
 }
 
 var dialer = &net.Dialer{
@@ -198,41 +536,217 @@ var bufferPool = sync.Pool{
 	},
 }
 
-func (b *backend) handle(c1 net.Conn) {
-	b.logf("accepted %v", c1.RemoteAddr())
-	c2, err := dialer.Dial("tcp", b.addr)
+// defaultIdleTimeout is used when proto.IdleTimeoutSeconds isn't set.
+const defaultIdleTimeout = 2 * time.Minute
+
+// spliceChunkSize bounds how many bytes spliceCopy asks the runtime to
+// move in one *net.TCPConn.ReadFrom call. It's kept small, rather than
+// sized for throughput, because the idle deadline is only reset between
+// calls: a single ReadFrom blocks for as long as it takes to either
+// fill the chunk or see EOF, so a large chunk lets a connection that's
+// trickling data in small reads (a slow IMAP/SMTP session, say) run
+// out its deadline despite being genuinely active the whole time.
+const spliceChunkSize = 16 << 10
+
+func (b *backend) handle(c1 net.Conn, info connInfo) {
+	start := time.Now()
+	logEvent("accepted", fields{"remote_addr": c1.RemoteAddr(), "backend": b.name, "sni": info.serverName, "alpn": info.alpnProto})
+	c2, err := b.dial()
 	if err != nil {
-		b.log(err)
+		logEvent("dial error", fields{"remote_addr": c1.RemoteAddr(), "backend": b.name, "error": err})
 		_ = c1.Close()
-		b.logf("disconnected %v", c1.RemoteAddr())
 		return
 	}
+	if b.proxyProto != "" {
+		if err := writeProxyHeader(c2, b.proxyProto, info); err != nil {
+			logEvent("proxy protocol write error", fields{"remote_addr": c1.RemoteAddr(), "backend": b.name, "error": err})
+			_ = c1.Close()
+			_ = c2.Close()
+			return
+		}
+	}
+	var deadline time.Time
+	if b.maxDuration != 0 {
+		deadline = time.Now().Add(b.maxDuration)
+	}
+	activeConnections.Inc(b.proto, b.host)
+	var bytesUp, bytesDown int64
+	var upErr, downErr error
 	first := make(chan<- struct{}, 1)
-	cp := func(dst net.Conn, src net.Conn) {
-		buf := bufferPool.Get().([]byte)
-		// TODO use splice on linux
-		// TODO needs some timeout to prevent torshammer ddos
-		_, err := io.CopyBuffer(dst, src, buf)
+	cp := func(dst net.Conn, src net.Conn, direction string, n *int64, errp *error) {
+		*n, *errp = copyConn(dst, src, b.idleTimeout, deadline)
+		bytesTotal.Add(float64(*n), direction, b.proto, b.host)
 		select {
 		case first <- struct{}{}:
-			if err != nil {
-				b.log(err)
-			}
 			_ = dst.Close()
 			_ = src.Close()
-			b.logf("disconnected %v", c1.RemoteAddr())
 		default:
 		}
-		bufferPool.Put(buf)
 	}
-	go cp(c1, c2)
-	cp(c2, c1)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		cp(c2, c1, "up", &bytesUp, &upErr)
+	}()
+	go func() {
+		defer wg.Done()
+		cp(c1, c2, "down", &bytesDown, &downErr)
+	}()
+	wg.Wait()
+	activeConnections.Dec(b.proto, b.host)
+	logEvent("disconnected", fields{
+		"remote_addr": c1.RemoteAddr(), "backend": b.name,
+		"bytes_up": bytesUp, "bytes_down": bytesDown,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"error":       firstNonNil(upErr, downErr),
+	})
 }
 
-func (b *backend) logf(format string, v ...interface{}) {
-	log.Printf(b.name+format, v...)
+// firstNonNil returns the first non-nil error, or nil if both are, so
+// the "disconnected" log line surfaces whichever direction actually
+// failed without two separate error fields.
+func firstNonNil(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (b *backend) log(err error) {
-	log.Print(b.name, err)
+// copyConn forwards src to dst, preferring to splice(2) the bytes
+// straight through the kernel when both ends turn out to be raw TCP
+// sockets underneath proxy.go's connection wrappers (true for
+// modePassthrough backends; a terminated TLS connection never
+// qualifies, since the bytes have to pass through userspace to be
+// en/decrypted anyway). idleTimeout bounds how long src may go without
+// producing a byte, reset after every successful transfer; deadline,
+// if set, additionally bounds the connection's total lifetime.
+func copyConn(dst, src net.Conn, idleTimeout time.Duration, deadline time.Time) (int64, error) {
+	leftover := drainPeekedBytes(src)
+	var written int64
+	if len(leftover) > 0 {
+		n, err := dst.Write(leftover)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if dtc, ok := rawTCPConn(dst); ok {
+		if stc, ok := rawTCPConn(src); ok {
+			n, err := spliceCopy(dtc, stc, idleTimeout, deadline)
+			return written + n, err
+		}
+	}
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	n, err := copyBuffered(dst, src, buf, idleTimeout, deadline)
+	return written + n, err
+}
+
+// drainPeekedBytes returns and discards whatever bytes are still
+// buffered for replay on c by an earlier peek (see bufferedConn),
+// walking through any proxyProtoConn wrapping in between. Splicing
+// straight from the raw connection underneath would otherwise skip
+// these bytes.
+func drainPeekedBytes(c net.Conn) []byte {
+	var leftover []byte
+	for {
+		switch v := c.(type) {
+		case *bufferedConn:
+			if v.buf != nil {
+				rest := make([]byte, v.buf.Len())
+				_, _ = v.buf.Read(rest)
+				leftover = append(leftover, rest...)
+				v.buf = nil
+			}
+			c = v.Conn
+		case *proxyProtoConn:
+			c = v.Conn
+		default:
+			return leftover
+		}
+	}
+}
+
+// rawTCPConn unwraps c through the connection wrappers proxy.go uses
+// (bufferedConn, proxyProtoConn) to recover the *net.TCPConn
+// underneath, if there is one. Safe to call without first draining any
+// peeked bytes, since neither wrapper intercepts Write, only Read.
+func rawTCPConn(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, true
+		case *bufferedConn:
+			c = v.Conn
+		case *proxyProtoConn:
+			c = v.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+// spliceCopy copies from src to dst spliceChunkSize bytes at a time
+// via *net.TCPConn.ReadFrom, which the runtime lowers to splice(2) on
+// Linux when, as here, both ends are TCP sockets (falling back to a
+// plain userspace copy on other platforms). Looping in chunks, rather
+// than handing ReadFrom the whole transfer at once, is what lets the
+// idle deadline be reset regularly.
+func spliceCopy(dst, src *net.TCPConn, idleTimeout time.Duration, deadline time.Time) (int64, error) {
+	var total int64
+	for {
+		if err := resetDeadline(src, idleTimeout, deadline); err != nil {
+			return total, err
+		}
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunkSize})
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < spliceChunkSize {
+			// Fewer bytes than asked for means src hit EOF.
+			return total, nil
+		}
+	}
+}
+
+// copyBuffered is the portable fallback for connections spliceCopy
+// can't handle, reading into buf and writing it back out a chunk at a
+// time so the idle deadline can be reset between reads.
+func copyBuffered(dst io.Writer, src net.Conn, buf []byte, idleTimeout time.Duration, deadline time.Time) (int64, error) {
+	var total int64
+	for {
+		if err := resetDeadline(src, idleTimeout, deadline); err != nil {
+			return total, err
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			wn, werr := dst.Write(buf[:n])
+			total += int64(wn)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return total, nil
+			}
+			return total, rerr
+		}
+	}
+}
+
+// resetDeadline sets src's read deadline to idleTimeout from now,
+// clamped to deadline if that's sooner, so a connection is evicted
+// once it either sits idle too long or, if deadline is set, has simply
+// been open too long regardless of activity.
+func resetDeadline(src net.Conn, idleTimeout time.Duration, deadline time.Time) error {
+	d := time.Now().Add(idleTimeout)
+	if !deadline.IsZero() && deadline.Before(d) {
+		d = deadline
+	}
+	return src.SetReadDeadline(d)
 }
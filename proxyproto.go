@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtoV2Sig is the fixed 12-byte signature that begins every
+// PROXY protocol v2 header.
+var proxyProtoV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// PROXY protocol v2 TLV types used when sending. pp2SubtypeSSLVersion
+// is itself a sub-TLV nested inside a pp2TypeSSL value.
+const (
+	pp2TypeALPN          = 0x01
+	pp2TypeAuthority     = 0x02
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	// pp2TypeIdentity is in the PROXY protocol spec's private-use TLV
+	// range (0xE0-0xEF) and carries the identity an Auth verified.
+	pp2TypeIdentity = 0xE0
+)
+
+// connInfo carries the handful of facts about a client connection
+// that backend.handle needs to build a PROXY protocol header. It's
+// populated differently depending on whether TLS was terminated
+// locally or the connection is being passed through: tlsVersion is 0
+// when unknown, i.e. for modePassthrough connections.
+type connInfo struct {
+	remoteAddr, localAddr net.Addr
+	serverName            string
+	alpnProto             string
+	tlsVersion            uint16
+	// clientCertVerified is true only when tlsVersion != 0 and the
+	// peer presented a client certificate that crypto/tls already
+	// verified as part of completing the handshake (see
+	// proxy.getConfigForClient); it's meaningless when tlsVersion is 0.
+	clientCertVerified bool
+	// identity is the principal an Auth verified, if any; see auth.go.
+	identity string
+}
+
+// writeProxyHeader writes a PROXY protocol header describing info to
+// w. version must be "v1" or "v2".
+func writeProxyHeader(w io.Writer, version string, info connInfo) error {
+	switch version {
+	case "v1":
+		return writeProxyV1Header(w, info)
+	case "v2":
+		return writeProxyV2Header(w, info)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+}
+
+func writeProxyV1Header(w io.Writer, info connInfo) error {
+	rtcp, ok := info.remoteAddr.(*net.TCPAddr)
+	ltcp, ok2 := info.localAddr.(*net.TCPAddr)
+	if !ok || !ok2 {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+	fam := "TCP4"
+	if rtcp.IP.To4() == nil {
+		fam = "TCP6"
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", fam, rtcp.IP, ltcp.IP, rtcp.Port, ltcp.Port)
+	return err
+}
+
+func writeProxyV2Header(w io.Writer, info connInfo) error {
+	rtcp, ok := info.remoteAddr.(*net.TCPAddr)
+	ltcp, ok2 := info.localAddr.(*net.TCPAddr)
+	if !ok || !ok2 {
+		return errors.New("PROXY protocol v2 requires TCP source and destination addresses")
+	}
+
+	var addr bytes.Buffer
+	var famProto byte
+	if ip4 := rtcp.IP.To4(); ip4 != nil {
+		famProto = 0x11 // AF_INET, STREAM
+		addr.Write(ip4)
+		addr.Write(ltcp.IP.To4())
+	} else {
+		famProto = 0x21 // AF_INET6, STREAM
+		addr.Write(rtcp.IP.To16())
+		addr.Write(ltcp.IP.To16())
+	}
+	binary.Write(&addr, binary.BigEndian, uint16(rtcp.Port))
+	binary.Write(&addr, binary.BigEndian, uint16(ltcp.Port))
+
+	var tlvs bytes.Buffer
+	if info.serverName != "" {
+		writeTLV(&tlvs, pp2TypeAuthority, []byte(info.serverName))
+	}
+	if info.tlsVersion != 0 {
+		var ssl bytes.Buffer
+		ssl.WriteByte(0x01) // PP2_CLIENT_SSL: the connection was secured with TLS
+		if info.clientCertVerified {
+			ssl.Write([]byte{0, 0, 0, 0}) // verify: 0 means a client cert was presented and verified
+		} else {
+			ssl.Write([]byte{0, 0, 0, 1}) // verify: nonzero means no verified client cert
+		}
+		writeTLV(&ssl, pp2SubtypeSSLVersion, []byte(tlsVersionString(info.tlsVersion)))
+		writeTLV(&tlvs, pp2TypeSSL, ssl.Bytes())
+	}
+	if info.alpnProto != "" {
+		writeTLV(&tlvs, pp2TypeALPN, []byte(info.alpnProto))
+	}
+	if info.identity != "" {
+		writeTLV(&tlvs, pp2TypeIdentity, []byte(info.identity))
+	}
+
+	var hdr bytes.Buffer
+	hdr.Write(proxyProtoV2Sig)
+	hdr.WriteByte(0x21) // version 2, PROXY command
+	hdr.WriteByte(famProto)
+	binary.Write(&hdr, binary.BigEndian, uint16(addr.Len()+tlvs.Len()))
+	hdr.Write(addr.Bytes())
+	hdr.Write(tlvs.Bytes())
+
+	_, err := w.Write(hdr.Bytes())
+	return err
+}
+
+func writeTLV(w *bytes.Buffer, typ byte, value []byte) {
+	w.WriteByte(typ)
+	binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.Write(value)
+}
+
+func tlsVersionString(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	default:
+		return "unknown"
+	}
+}
+
+// proxyProtoConn overrides RemoteAddr with the client address recovered
+// from an incoming PROXY protocol header.
+type proxyProtoConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// acceptProxyProtoHeader reads and strips a PROXY protocol v1 or v2
+// header off c, returning a connection that replays whatever c's
+// buffered reader looked ahead at past the header, and the recovered
+// client address. addr is nil if the header carried no address (a
+// v1 "UNKNOWN" or a v2 LOCAL command), in which case c's own
+// RemoteAddr should keep being used.
+func acceptProxyProtoHeader(c net.Conn) (net.Conn, net.Addr, error) {
+	br := bufio.NewReader(c)
+	addr, err := readProxyHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	leftover := make([]byte, br.Buffered())
+	if _, err := io.ReadFull(br, leftover); err != nil {
+		return nil, nil, fmt.Errorf("draining PROXY protocol header buffer: %v", err)
+	}
+	return &bufferedConn{Conn: c, buf: bytes.NewReader(leftover)}, addr, nil
+}
+
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		return readProxyV2Header(r)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol v1 header: %v", err)
+	}
+	return parseProxyV1Line(line)
+}
+
+func parseProxyV1Line(line string) (net.Addr, error) {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", line)
+	}
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil {
+		return nil, fmt.Errorf("invalid source address in PROXY protocol v1 header: %q", fields[2])
+	}
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in PROXY protocol v1 header: %q", fields[4])
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol v2 header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0x0F
+	famProto := hdr[13]
+	addrLen := int(binary.BigEndian.Uint16(hdr[14:16]))
+	body := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol v2 address block: %v", err)
+	}
+	if cmd == 0x00 {
+		// LOCAL: a health check from the load balancer itself, no
+		// client address to recover.
+		return nil, nil
+	}
+	switch famProto >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY protocol v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY protocol v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX: no routable address to recover.
+		return nil, nil
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseProxyV1Line(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantIP   string
+		wantPort int
+		wantNil  bool
+		wantErr  bool
+	}{
+		{
+			name:     "tcp4",
+			line:     "PROXY TCP4 192.168.0.1 192.168.0.2 56324 443\r\n",
+			wantIP:   "192.168.0.1",
+			wantPort: 56324,
+		},
+		{
+			name:    "unknown",
+			line:    "PROXY UNKNOWN\r\n",
+			wantNil: true,
+		},
+		{
+			name:    "wrong signature",
+			line:    "GET / HTTP/1.1\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "wrong field count",
+			line:    "PROXY TCP4 192.168.0.1 192.168.0.2 56324\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid source address",
+			line:    "PROXY TCP4 not-an-ip 192.168.0.2 56324 443\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := parseProxyV1Line(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantNil {
+				if addr != nil {
+					t.Errorf("got %v, want nil", addr)
+				}
+				return
+			}
+			tcp, ok := addr.(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("got %T, want *net.TCPAddr", addr)
+			}
+			if tcp.IP.String() != tt.wantIP || tcp.Port != tt.wantPort {
+				t.Errorf("got %s:%d, want %s:%d", tcp.IP, tcp.Port, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestWriteProxyV1Header(t *testing.T) {
+	info := connInfo{
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+	}
+	var buf bytes.Buffer
+	if err := writeProxyV1Header(&buf, info); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "PROXY TCP4 10.0.0.1 10.0.0.2 1234 443\r\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
+
+// TestWriteReadProxyV2Header round-trips writeProxyV2Header through
+// readProxyV2Header, which is the same parser acceptProxyProtoHeader
+// uses on an incoming connection from an upstream proxy.
+func TestWriteReadProxyV2Header(t *testing.T) {
+	info := connInfo{
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51234},
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("203.0.113.2"), Port: 443},
+	}
+	var buf bytes.Buffer
+	if err := writeProxyV2Header(&buf, info); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr, err := readProxyV2Header(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("got %T, want *net.TCPAddr", addr)
+	}
+	if !tcp.IP.Equal(net.ParseIP("203.0.113.1")) || tcp.Port != 51234 {
+		t.Errorf("got %s:%d, want 203.0.113.1:51234", tcp.IP, tcp.Port)
+	}
+}
+
+func TestWriteProxyV2HeaderVerifyByte(t *testing.T) {
+	base := connInfo{
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 51234},
+		localAddr:  &net.TCPAddr{IP: net.ParseIP("203.0.113.2"), Port: 443},
+		tlsVersion: 0x0304, // TLS 1.3
+	}
+
+	tests := []struct {
+		name               string
+		clientCertVerified bool
+		wantVerify         byte
+	}{
+		{name: "no client cert", clientCertVerified: false, wantVerify: 1},
+		{name: "verified client cert", clientCertVerified: true, wantVerify: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := base
+			info.clientCertVerified = tt.clientCertVerified
+			var buf bytes.Buffer
+			if err := writeProxyV2Header(&buf, info); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// The PP2_CLIENT_SSL sub-TLV's verify field is the 4 bytes
+			// right after its 1-byte client bitfield; find it by
+			// locating the pp2TypeSSL TLV's tag byte.
+			idx := bytes.IndexByte(buf.Bytes(), pp2TypeSSL)
+			if idx < 0 {
+				t.Fatal("pp2TypeSSL TLV not found in header")
+			}
+			// idx+1,idx+2: sub-TLV length; idx+3: client bitfield; idx+4..idx+8: verify.
+			verify := buf.Bytes()[idx+7]
+			if verify != tt.wantVerify {
+				t.Errorf("verify byte = %d, want %d", verify, tt.wantVerify)
+			}
+		})
+	}
+}
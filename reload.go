@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nhooyr/log"
+)
+
+// envListenerFDs names the environment variable set on a re-exec'd
+// child listing the inherited listener file descriptor numbers, in
+// the same order they were bound in, so the child recovers them
+// instead of binding fresh sockets.
+const envListenerFDs = "TLSMUXD_LISTENER_FDS"
+
+// envTunnelFD is the equivalent of envListenerFDs for the optional
+// tunnel control-plane listener.
+const envTunnelFD = "TLSMUXD_TUNNEL_FD"
+
+// envMetricsFD is the equivalent of envListenerFDs for the optional
+// metrics/debug listener.
+const envMetricsFD = "TLSMUXD_METRICS_FD"
+
+// defaultDrainTimeout bounds how long shutdown waits for in-flight
+// connections to finish on their own before force-closing them, when
+// proxy.DrainTimeoutSeconds isn't set.
+const defaultDrainTimeout = 30 * time.Second
+
+// server owns the listeners and the proxy serving them, and drives
+// SIGHUP reload, SIGUSR2 fork-for-validation, and SIGTERM/SIGINT
+// graceful shutdown.
+type server struct {
+	p               *proxy
+	listeners       []*net.TCPListener
+	tunnelListener  *net.TCPListener
+	metricsListener *net.TCPListener
+}
+
+// loadProxy reads and validates config.json in the current directory.
+// It's used both at startup and to sanity-check a config edit before
+// a SIGHUP reload commits to it.
+func loadProxy() (*proxy, error) {
+	f, err := os.Open("config.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := new(proxy)
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, err
+	}
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// listen binds p.BindInterfaces, or, if this process was re-exec'd by
+// a reload, recovers the inherited listener fds instead so bound
+// :443 sockets never close across a reload.
+func (s *server) listen() error {
+	if fds := os.Getenv(envListenerFDs); fds != "" {
+		if err := s.inherit(fds); err != nil {
+			return err
+		}
+	} else {
+		for _, host := range s.p.BindInterfaces {
+			l, err := net.Listen("tcp", net.JoinHostPort(host, "https"))
+			if err != nil {
+				return err
+			}
+			s.listeners = append(s.listeners, l.(*net.TCPListener))
+		}
+	}
+
+	if s.p.TunnelListenAddr != "" {
+		if fd := os.Getenv(envTunnelFD); fd != "" {
+			l, err := inheritListener(fd, "tunnel")
+			if err != nil {
+				return err
+			}
+			s.tunnelListener = l
+		} else {
+			l, err := net.Listen("tcp", s.p.TunnelListenAddr)
+			if err != nil {
+				return err
+			}
+			s.tunnelListener = l.(*net.TCPListener)
+		}
+	}
+
+	if s.p.MetricsListenAddr != "" {
+		if fd := os.Getenv(envMetricsFD); fd != "" {
+			l, err := inheritListener(fd, "metrics")
+			if err != nil {
+				return err
+			}
+			s.metricsListener = l
+		} else {
+			l, err := net.Listen("tcp", s.p.MetricsListenAddr)
+			if err != nil {
+				return err
+			}
+			s.metricsListener = l.(*net.TCPListener)
+		}
+	}
+	return nil
+}
+
+func (s *server) inherit(fds string) error {
+	for i, fd := range strings.Split(fds, ",") {
+		l, err := inheritListener(fd, fmt.Sprintf("listener-%d", i))
+		if err != nil {
+			return err
+		}
+		s.listeners = append(s.listeners, l)
+	}
+	return nil
+}
+
+func inheritListener(fd, name string) (*net.TCPListener, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inherited fd %q: %v", fd, err)
+	}
+	f := os.NewFile(uintptr(n), name)
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("recovering inherited listener fd %d: %v", n, err)
+	}
+	_ = f.Close() // net.FileListener dups the fd, so this one is no longer needed.
+	return l.(*net.TCPListener), nil
+}
+
+// serve starts serving every listener and blocks until all of them
+// stop, which only happens once shutdown or a reload closes them.
+func (s *server) serve() {
+	var wg sync.WaitGroup
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l *net.TCPListener) {
+			defer wg.Done()
+			err := s.p.serve(tcpKeepAliveListener{l})
+			if err != nil && !isUseOfClosedConn(err) {
+				log.Fatal(err)
+			}
+		}(l)
+	}
+	if s.tunnelListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.p.serveTunnelControl(s.tunnelListener)
+			if err != nil && !isUseOfClosedConn(err) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if s.metricsListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv := &http.Server{Handler: s.p.metricsMux()}
+			err := srv.Serve(s.metricsListener)
+			if err != nil && !isUseOfClosedConn(err) {
+				log.Fatal(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func isUseOfClosedConn(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// drainTimeout returns the configured drain timeout, or the default
+// if it wasn't set.
+func (s *server) drainTimeout() time.Duration {
+	if s.p.DrainTimeoutSeconds == 0 {
+		return defaultDrainTimeout
+	}
+	return time.Duration(s.p.DrainTimeoutSeconds) * time.Second
+}
+
+// shutdown closes every listener so serve's Accept loops return, then
+// waits up to drainTimeout for in-flight connections to finish before
+// force-closing whatever is left.
+func (s *server) shutdown() {
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	if s.tunnelListener != nil {
+		_ = s.tunnelListener.Close()
+	}
+	if s.metricsListener != nil {
+		_ = s.metricsListener.Close()
+	}
+	s.p.drain(s.drainTimeout())
+}
+
+// reexec forks a copy of the running binary, passing it the listener
+// fds via ExtraFiles and envListenerFDs so it can resume serving them
+// without ever closing the bound sockets.
+func (s *server) reexec() (*os.Process, error) {
+	files := make([]*os.File, len(s.listeners))
+	fds := make([]string, len(s.listeners))
+	for i, l := range s.listeners {
+		f, err := l.File()
+		if err != nil {
+			return nil, fmt.Errorf("dup'ing listener %d: %v", i, err)
+		}
+		files[i] = f
+		fds[i] = strconv.Itoa(3 + i)
+	}
+	env := append(os.Environ(), envListenerFDs+"="+strings.Join(fds, ","))
+
+	if s.tunnelListener != nil {
+		f, err := s.tunnelListener.File()
+		if err != nil {
+			return nil, fmt.Errorf("dup'ing tunnel listener: %v", err)
+		}
+		env = append(env, fmt.Sprintf("%s=%d", envTunnelFD, 3+len(files)))
+		files = append(files, f)
+	}
+
+	if s.metricsListener != nil {
+		f, err := s.metricsListener.File()
+		if err != nil {
+			return nil, fmt.Errorf("dup'ing metrics listener: %v", err)
+		}
+		env = append(env, fmt.Sprintf("%s=%d", envMetricsFD, 3+len(files)))
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("resolving executable path: %v", err)
+	}
+	return os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+}
+
+// handleSignals drives the signal-triggered lifecycle events: SIGHUP
+// reloads by handing the listener fds to a freshly exec'd child and
+// draining this process's connections, SIGUSR2 forks the same child
+// without shutting down so an operator can validate it first, and
+// SIGINT/SIGTERM drain and exit in place.
+func (s *server) handleSignals(sigs <-chan os.Signal) {
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Print("received SIGHUP, reloading")
+			validated, err := loadProxy()
+			if err != nil {
+				log.Printf("not reloading, new config is invalid: %v", err)
+				continue
+			}
+			// validated was only built to check the candidate config;
+			// the new process started by reexec loads its own. Stop
+			// its background goroutines before discarding it.
+			close(validated.stop)
+			if _, err := s.reexec(); err != nil {
+				log.Printf("reload failed: %v", err)
+				continue
+			}
+			log.Print("handed off listeners to new process, draining")
+			s.shutdown()
+			os.Exit(0)
+		case syscall.SIGUSR2:
+			log.Print("received SIGUSR2, forking for validation")
+			if _, err := s.reexec(); err != nil {
+				log.Printf("fork failed: %v", err)
+			}
+		default:
+			log.Printf("received %v, shutting down", sig)
+			s.shutdown()
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Package acme is a local stand-in for github.com/xenolf/lego/acme.
+// The real module predates go modules, pulls in a much larger ACME v1
+// client than this tree needs, and (at the versions this tree was
+// written against) doesn't resolve cleanly through a module proxy; all
+// this tree actually uses is the package-level Logger var, silenced in
+// main.go's init. See the replace directive in the root go.mod.
+package acme
+
+import stdlog "log"
+
+// Logger is the real package's output sink; main.go redirects it to
+// ioutil.Discard so the library's own logging never interleaves with
+// tlsmuxd's structured log lines.
+var Logger *stdlog.Logger
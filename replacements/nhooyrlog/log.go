@@ -0,0 +1,13 @@
+// Package log is a local stand-in for github.com/nhooyr/log, which
+// this tree has always depended on for its Print/Fatal-style helpers
+// but which predates go modules and was never published with tags, so
+// it can't be resolved through a module proxy. See the replace
+// directive in the root go.mod.
+package log
+
+import "log"
+
+func Print(v ...interface{})                 { log.Print(v...) }
+func Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+func Fatal(v ...interface{})                 { log.Fatal(v...) }
+func Fatalf(format string, v ...interface{}) { log.Fatalf(format, v...) }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/yamux"
+
+	"github.com/nhooyr/log"
+)
+
+// tunnelPrefix marks a hostConfig.Addr as a reverse-tunnel backend
+// rather than a dial address: "tunnel://deploy-box" instead of
+// "10.0.0.5:8080".
+const tunnelPrefix = "tunnel://"
+
+// tunnelRegistry tracks the yamux sessions of currently-registered
+// tunnel agents, keyed by the id they registered under.
+type tunnelRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*yamux.Session
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{sessions: make(map[string]*yamux.Session)}
+}
+
+// register stores sess under id, replacing and closing whatever
+// session was previously registered there, and removes it once sess
+// itself closes.
+func (r *tunnelRegistry) register(id string, sess *yamux.Session) {
+	r.mu.Lock()
+	if old, ok := r.sessions[id]; ok {
+		_ = old.Close()
+	}
+	r.sessions[id] = sess
+	r.mu.Unlock()
+
+	go func() {
+		<-sess.CloseChan()
+		r.mu.Lock()
+		if r.sessions[id] == sess {
+			delete(r.sessions, id)
+		}
+		r.mu.Unlock()
+	}()
+}
+
+// dial opens a new multiplexed stream to the agent registered as id.
+func (r *tunnelRegistry) dial(id string) (net.Conn, error) {
+	r.mu.Lock()
+	sess, ok := r.sessions[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no tunnel agent registered for %q", id)
+	}
+	return sess.Open()
+}
+
+// serveTunnelControl accepts connections from reverse-tunnel agents.
+// Each connection starts with a single "id:token\n" registration
+// line, checked against p.TunnelAgents, after which it's handed to
+// yamux as the control connection agents open new streams on.
+func (p *proxy) serveTunnelControl(l net.Listener) error {
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleTunnelControl(c)
+	}
+}
+
+func (p *proxy) handleTunnelControl(c net.Conn) {
+	br := bufio.NewReader(c)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		log.Printf("tunnel: reading registration from %v: %v", c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+	id, token, ok := splitOnce(strings.TrimRight(line, "\r\n"), ":")
+	want, registered := p.TunnelAgents[id]
+	if !ok || token == "" || !registered || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		log.Printf("tunnel: rejecting registration from %v for %q", c.RemoteAddr(), id)
+		_ = c.Close()
+		return
+	}
+	// Anything buffered past the registration line is the start of
+	// the yamux session; replay it instead of dropping it.
+	leftover := make([]byte, br.Buffered())
+	if _, err := io.ReadFull(br, leftover); err != nil {
+		log.Printf("tunnel: draining registration buffer from %v: %v", c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+	conn := net.Conn(c)
+	if len(leftover) > 0 {
+		conn = &bufferedConn{Conn: c, buf: bytes.NewReader(leftover)}
+	}
+	sess, err := yamux.Server(conn, nil)
+	if err != nil {
+		log.Printf("tunnel: yamux handshake with %v: %v", c.RemoteAddr(), err)
+		_ = c.Close()
+		return
+	}
+	p.tunnels.register(id, sess)
+	log.Printf("tunnel: %q registered from %v", id, c.RemoteAddr())
+}